@@ -7,10 +7,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
 )
 
 // QemuImg is the version of qemu container
@@ -23,12 +25,22 @@ type QemuConfig struct {
 	UEFI           bool
 	Kernel         bool
 	GUI            bool
-	DiskPath       string
-	DiskSize       string
+	Disks          Disks
 	FWPath         string
+	FWVarsPath     string
 	Arch           string
 	CPUs           string
 	Memory         string
+	Accel          string
+	Machine        string
+	Networking     Networking
+	Detached       bool
+	QMPSockPath    string
+	Serial         string
+	UUID           string
+	Data           string
+	DataFile       string
+	DataISOPath    string
 	KVM            bool
 	Containerized  bool
 	QemuBinPath    string
@@ -36,6 +48,13 @@ type QemuConfig struct {
 	PublishedPorts []string
 }
 
+// Networking holds the parsed -networking configuration.
+type Networking struct {
+	Mode   string
+	IfName string
+	Bridge string
+}
+
 func runQemu(args []string) {
 	invoked := filepath.Base(os.Args[0])
 	flags := flag.NewFlagSet("qemu", flag.ExitOnError)
@@ -54,14 +73,25 @@ func runQemu(args []string) {
 	kernelBoot := flags.Bool("kernel", true, "Set boot using 'prefix'-kernel/-initrd/-cmdline")
 
 	// Paths and settings for Disks and UEFI firware
-	disk := flags.String("disk", "", "Path to disk image to use")
-	diskSz := flags.String("disk-size", "", "Size of disk to create, only created if it doesn't exist")
-	fw := flags.String("fw", "/usr/share/ovmf/bios.bin", "Path to OVMF firmware for UEFI boot")
+	disks := Disks{}
+	flags.Var(&disks, "disk", "Disk config, may be repeated. [file=]path[,size=1G][,format=qcow2][,if=virtio|ide|scsi]")
+	fw := flags.String("fw", "", "Path to OVMF/AAVMF firmware for UEFI boot, auto-discovered if not set")
+	fwVars := flags.String("fw-vars", "", "Path to an OVMF/AAVMF VARS file, overrides the discovered default")
 
 	// VM configuration
 	arch := flags.String("arch", "x86_64", "Type of architecture to use, e.g. x86_64, aarch64")
 	cpus := flags.String("cpus", "1", "Number of CPUs")
 	mem := flags.String("mem", "1024", "Amount of memory in MB")
+	accel := flags.String("accel", "kvm:hvf:tcg", "Acceleration methods to try, in order of preference, e.g. kvm:hvf:tcg")
+	machine := flags.String("machine", "", "QEMU machine type, defaults to 'virt' on aarch64 and 'q35' on x86_64")
+	networking := flags.String("networking", "user", "Networking mode: none|user|tap[,ifname=name]|bridge,br=name")
+
+	detached := flags.Bool("detached", false, "Set qemu to run in the background")
+	qmp := flags.String("qmp", "", "Path to a unix socket to expose the QMP control interface on")
+	serial := flags.String("serial", "", "Where to send the VM's serial console: file|pty|tcp:host:port (default: '<prefix>.log' when -detached)")
+
+	data := flags.String("data", "", "String of cloud-init/ignition user-data to seed the VM with")
+	dataFile := flags.String("data-file", "", "Path to a file of cloud-init/ignition user-data to seed the VM with")
 
 	publishFlags := multipleFlag{}
 	flags.Var(&publishFlags, "publish", "Publish a vm's port(s) to the host (default [])")
@@ -83,24 +113,49 @@ func runQemu(args []string) {
 		log.Warnf("Both -iso and -uefi have been used")
 	}
 
+	net, err := parseNetworkingSpec(*networking)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	var fwResolved firmware
+	if *uefiBoot {
+		fwResolved, err = discoverFirmware(*arch, *fw, *fwVars)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
 	config := QemuConfig{
 		Prefix:         prefix,
 		ISO:            *isoBoot,
 		UEFI:           *uefiBoot,
 		Kernel:         *kernelBoot,
 		GUI:            *enableGUI,
-		DiskPath:       *disk,
-		DiskSize:       *diskSz,
-		FWPath:         *fw,
+		Disks:          disks,
+		FWPath:         fwResolved.Code,
+		FWVarsPath:     fwResolved.Vars,
 		Arch:           *arch,
 		CPUs:           *cpus,
 		Memory:         *mem,
+		Accel:          *accel,
+		Machine:        *machine,
+		Networking:     net,
+		Detached:       *detached,
+		QMPSockPath:    *qmp,
+		Serial:         *serial,
+		UUID:           uuid.NewV4().String(),
+		Data:           *data,
+		DataFile:       *dataFile,
 		PublishedPorts: publishFlags,
 	}
 
 	config = discoverBackend(config)
 
-	var err error
+	if config.Containerized && (config.Networking.Mode == "tap" || config.Networking.Mode == "bridge") {
+		log.Fatalf("Networking mode %q is not supported in containerized mode", config.Networking.Mode)
+	}
+
 	if config.Containerized {
 		err = runQemuContainer(config)
 	} else {
@@ -112,34 +167,40 @@ func runQemu(args []string) {
 }
 
 func runQemuLocal(config QemuConfig) error {
+	if config.UEFI && config.FWVarsPath != "" {
+		varsCopy := config.Prefix + "-efi-vars.fd"
+		if err := copyFirmwareVars(config.FWVarsPath, varsCopy); err != nil {
+			return err
+		}
+		config.FWVarsPath = varsCopy
+	}
+
+	if config.Data != "" || config.DataFile != "" {
+		isoPath := config.Prefix + "-cidata.iso"
+		if err := buildCidataISO(config, isoPath); err != nil {
+			return err
+		}
+		config.DataISOPath = isoPath
+	}
+
 	var args []string
 	config, args = buildQemuCmdline(config)
 
-	if config.DiskPath != "" {
+	for _, disk := range config.Disks {
 		// If disk doesn't exist then create one
-		if _, err := os.Stat(config.DiskPath); err != nil {
+		if _, err := os.Stat(disk.Path); err != nil {
 			if os.IsNotExist(err) {
-				log.Infof("Creating new qemu disk [%s]", config.DiskPath)
-				qemuImgCmd := exec.Command(config.QemuImgPath, "create", "-f", "qcow2", config.DiskPath, config.DiskSize)
+				log.Infof("Creating new qemu disk [%s]", disk.Path)
+				qemuImgCmd := exec.Command(config.QemuImgPath, "create", "-f", disk.Format, disk.Path, disk.Size)
 				log.Debugf("%v\n", qemuImgCmd.Args)
 				if err := qemuImgCmd.Run(); err != nil {
-					return fmt.Errorf("Error creating disk [%s]:  %s", config.DiskPath, err.Error())
+					return fmt.Errorf("Error creating disk [%s]:  %s", disk.Path, err.Error())
 				}
 			} else {
 				return err
 			}
 		} else {
-			log.Infof("Using existing disk [%s]", config.DiskPath)
-		}
-	}
-
-	// Check for OVMF firmware before running
-	if config.UEFI {
-		if _, err := os.Stat(config.FWPath); err != nil {
-			if os.IsNotExist(err) {
-				return fmt.Errorf("File [%s] does not exist, please ensure OVMF is installed", config.FWPath)
-			}
-			return err
+			log.Infof("Using existing disk [%s]", disk.Path)
 		}
 	}
 
@@ -147,8 +208,9 @@ func runQemuLocal(config QemuConfig) error {
 	// If verbosity is enabled print out the full path/arguments
 	log.Debugf("%v\n", qemuCmd.Args)
 
-	// If we're not using a separate window then link the execution to stdin/out
-	if config.GUI != true {
+	// If we're not using a separate window or running detached then link the
+	// execution to stdin/out
+	if config.GUI != true && !config.Detached {
 		qemuCmd.Stdin = os.Stdin
 		qemuCmd.Stdout = os.Stdout
 		qemuCmd.Stderr = os.Stderr
@@ -171,10 +233,35 @@ func runQemuContainer(config QemuConfig) error {
 		}
 	}
 
+	if config.UEFI && config.FWVarsPath != "" {
+		// The VARS copy must land under wd, the directory bind-mounted to
+		// /tmp in the container, and be referenced by its relative name so
+		// qemu can find it there.
+		varsCopy := config.Prefix + "-efi-vars.fd"
+		if err := copyFirmwareVars(config.FWVarsPath, filepath.Join(wd, varsCopy)); err != nil {
+			return err
+		}
+		config.FWVarsPath = varsCopy
+	}
+
+	if config.Data != "" || config.DataFile != "" {
+		// Same wd/relative-name dance as the firmware VARS copy above: the
+		// ISO must land under wd so the bind-mounted container can see it.
+		isoPath := config.Prefix + "-cidata.iso"
+		if err := buildCidataISO(config, filepath.Join(wd, isoPath)); err != nil {
+			return err
+		}
+		config.DataISOPath = isoPath
+	}
+
 	var args []string
 	config, args = buildQemuCmdline(config)
 
-	dockerArgs := []string{"run", "-i", "--rm", "-v", fmt.Sprintf("%s:%s", wd, "/tmp"), "-w", "/tmp"}
+	runFlag := "-i"
+	if config.Detached {
+		runFlag = "-d"
+	}
+	dockerArgs := []string{"run", runFlag, "--rm", "-v", fmt.Sprintf("%s:%s", wd, "/tmp"), "-w", "/tmp"}
 
 	if config.KVM {
 		dockerArgs = append(dockerArgs, "--device", "/dev/kvm")
@@ -193,22 +280,22 @@ func runQemuContainer(config QemuConfig) error {
 		return fmt.Errorf("Unable to find docker in the $PATH")
 	}
 
-	if config.DiskPath != "" {
+	for _, disk := range config.Disks {
 		// If disk doesn't exist then create one
-		if _, err = os.Stat(config.DiskPath); err != nil {
+		if _, err = os.Stat(disk.Path); err != nil {
 			if os.IsNotExist(err) {
-				log.Infof("Creating new qemu disk [%s]", config.DiskPath)
-				imgArgs := append(dockerArgs, QemuImg, "qemu-img", "create", "-f", "qcow2", config.DiskPath, config.DiskSize)
+				log.Infof("Creating new qemu disk [%s]", disk.Path)
+				imgArgs := append(dockerArgs, QemuImg, "qemu-img", "create", "-f", disk.Format, disk.Path, disk.Size)
 				qemuImgCmd := exec.Command(dockerPath, imgArgs...)
 				log.Debugf("%v\n", qemuImgCmd.Args)
 				if err = qemuImgCmd.Run(); err != nil {
-					return fmt.Errorf("Error creating disk [%s]:  %s", config.DiskPath, err.Error())
+					return fmt.Errorf("Error creating disk [%s]:  %s", disk.Path, err.Error())
 				}
 			} else {
 				return err
 			}
 		} else {
-			log.Infof("Using existing disk [%s]", config.DiskPath)
+			log.Infof("Using existing disk [%s]", disk.Path)
 		}
 	}
 
@@ -223,9 +310,11 @@ func runQemuContainer(config QemuConfig) error {
 		return fmt.Errorf("GUI mode is only supported when running locally, not in a container")
 	}
 
-	qemuCmd.Stdin = os.Stdin
-	qemuCmd.Stdout = os.Stdout
-	qemuCmd.Stderr = os.Stderr
+	if !config.Detached {
+		qemuCmd.Stdin = os.Stdin
+		qemuCmd.Stdout = os.Stdout
+		qemuCmd.Stderr = os.Stderr
+	}
 
 	return qemuCmd.Run()
 }
@@ -236,19 +325,34 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 	qemuArgs = append(qemuArgs, "-device", "virtio-rng-pci")
 	qemuArgs = append(qemuArgs, "-smp", config.CPUs)
 	qemuArgs = append(qemuArgs, "-m", config.Memory)
+	qemuArgs = append(qemuArgs, "-uuid", config.UUID)
+	qemuArgs = append(qemuArgs, "-smbios", fmt.Sprintf("type=1,serial=%s,uuid=%s", config.UUID, config.UUID))
 
-	// Look for kvm device and enable for qemu if it exists
-	var err error
-	if _, err = os.Stat("/dev/kvm"); os.IsNotExist(err) {
-		qemuArgs = append(qemuArgs, "-machine", "virt")
-	} else {
+	machine := config.Machine
+	if machine == "" {
+		machine = defaultMachine(config.Arch)
+	}
+
+	switch selectAccel(config.Accel, config.Containerized) {
+	case "kvm":
 		config.KVM = true
-		qemuArgs = append(qemuArgs, "-enable-kvm")
-		qemuArgs = append(qemuArgs, "-machine", "virt")
+		qemuArgs = append(qemuArgs, "-accel", "kvm", "-cpu", "host")
+	case "hvf":
+		qemuArgs = append(qemuArgs, "-accel", "hvf")
+	default:
+		qemuArgs = append(qemuArgs, "-accel", "tcg")
+	}
+	qemuArgs = append(qemuArgs, "-machine", machine)
+
+	ifaceIndex := map[string]int{}
+	for _, disk := range config.Disks {
+		index := ifaceIndex[disk.Interface]
+		ifaceIndex[disk.Interface] = index + 1
+		qemuArgs = append(qemuArgs, "-drive", fmt.Sprintf("file=%s,format=%s,if=%s,index=%d,media=disk", disk.Path, disk.Format, disk.Interface, index))
 	}
 
-	if config.DiskPath != "" {
-		qemuArgs = append(qemuArgs, "-drive", "file="+config.DiskPath+",format=qcow2,index=0,media=disk")
+	if config.DataISOPath != "" {
+		qemuArgs = append(qemuArgs, "-drive", fmt.Sprintf("file=%s,format=raw,if=virtio,media=cdrom", config.DataISOPath))
 	}
 
 	// Check flags for iso/uefi boot and if so disable kernel boot
@@ -261,7 +365,12 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 	if config.UEFI {
 		config.Kernel = false
 		qemuIsoPath := buildPath(config.Prefix, "-efi.iso")
-		qemuArgs = append(qemuArgs, "-pflash", config.FWPath)
+		if config.FWVarsPath != "" {
+			qemuArgs = append(qemuArgs, "-drive", fmt.Sprintf("if=pflash,format=raw,readonly=on,file=%s", config.FWPath))
+			qemuArgs = append(qemuArgs, "-drive", fmt.Sprintf("if=pflash,format=raw,file=%s", config.FWVarsPath))
+		} else {
+			qemuArgs = append(qemuArgs, "-pflash", config.FWPath)
+		}
 		qemuArgs = append(qemuArgs, "-cdrom", qemuIsoPath)
 		qemuArgs = append(qemuArgs, "-boot", "d")
 	}
@@ -281,22 +390,264 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		}
 	}
 
-	if config.PublishedPorts != nil && len(config.PublishedPorts) > 0 {
-		forwardings, err := buildQemuForwardings(config.PublishedPorts, config.Containerized)
-		if err != nil {
-			log.Error(err)
+	switch config.Networking.Mode {
+	case "none":
+		qemuArgs = append(qemuArgs, "-net", "none")
+	case "tap":
+		ifname := config.Networking.IfName
+		if ifname == "" {
+			ifname = "tap0"
+		}
+		qemuArgs = append(qemuArgs, "-netdev", fmt.Sprintf("tap,id=n0,ifname=%s,script=no,downscript=no", ifname))
+		qemuArgs = append(qemuArgs, "-device", fmt.Sprintf("virtio-net-pci,netdev=n0,mac=%s", generateMAC()))
+	case "bridge":
+		qemuArgs = append(qemuArgs, "-netdev", fmt.Sprintf("bridge,id=n0,br=%s", config.Networking.Bridge))
+		qemuArgs = append(qemuArgs, "-device", fmt.Sprintf("virtio-net-pci,netdev=n0,mac=%s", generateMAC()))
+	default:
+		netdev := "user,id=n0"
+		if config.PublishedPorts != nil && len(config.PublishedPorts) > 0 {
+			forwardings, err := buildQemuForwardings(config.PublishedPorts, config.Containerized)
+			if err != nil {
+				log.Error(err)
+			}
+			netdev = fmt.Sprintf("%s,%s", netdev, forwardings)
 		}
-		qemuArgs = append(qemuArgs, "-net", forwardings)
-		qemuArgs = append(qemuArgs, "-net", "nic")
+		qemuArgs = append(qemuArgs, "-netdev", netdev)
+		qemuArgs = append(qemuArgs, "-device", fmt.Sprintf("virtio-net-pci,netdev=n0,mac=%s", generateMAC()))
+	}
+
+	serialSink := config.Serial
+	if serialSink == "" && config.Detached {
+		serialSink = config.Prefix + ".log"
 	}
 
 	if config.GUI != true {
-		qemuArgs = append(qemuArgs, "-nographic")
+		if serialSink != "" {
+			qemuArgs = append(qemuArgs, "-display", "none")
+		} else {
+			qemuArgs = append(qemuArgs, "-nographic")
+		}
+	}
+
+	if serialSink != "" {
+		qemuArgs = append(qemuArgs, "-serial", buildSerialArg(serialSink))
+	}
+
+	if config.QMPSockPath != "" {
+		qemuArgs = append(qemuArgs, "-qmp", fmt.Sprintf("unix:%s,server,nowait", config.QMPSockPath))
+	}
+
+	if config.Detached && !config.Containerized {
+		// In containerized mode "docker run -d" is already the detach
+		// mechanism: qemu runs as the container's PID 1, so letting it
+		// -daemonize (fork and exit) would pull the rug out from under the
+		// container and have Docker tear down the whole thing.
+		qemuArgs = append(qemuArgs, "-daemonize", "-pidfile", config.Prefix+".pid")
 	}
 
 	return config, qemuArgs
 }
 
+// firmware describes an OVMF/AAVMF firmware image, either a single combined
+// image or a split CODE/VARS pair.
+type firmware struct {
+	Code string
+	Vars string
+}
+
+// firmwareCandidates lists the usual install locations for OVMF (x86_64) and
+// AAVMF (aarch64) across common Linux distros, plus Homebrew on macOS.
+func firmwareCandidates(arch string) []firmware {
+	switch arch {
+	case "aarch64":
+		return []firmware{
+			{Code: "/usr/share/AAVMF/AAVMF_CODE.fd", Vars: "/usr/share/AAVMF/AAVMF_VARS.fd"},
+			{Code: "/usr/share/edk2/aarch64/QEMU_EFI.fd", Vars: "/usr/share/edk2/aarch64/vars-template-pflash.raw"},
+			{Code: "/opt/homebrew/share/qemu/edk2-aarch64-code.fd", Vars: "/opt/homebrew/share/qemu/edk2-arm-vars.fd"},
+		}
+	default:
+		return []firmware{
+			{Code: "/usr/share/OVMF/OVMF_CODE.fd", Vars: "/usr/share/OVMF/OVMF_VARS.fd"},
+			{Code: "/usr/share/edk2-ovmf/x64/OVMF_CODE.fd", Vars: "/usr/share/edk2-ovmf/x64/OVMF_VARS.fd"},
+			{Code: "/usr/share/edk2/ovmf/OVMF_CODE.fd", Vars: "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+			{Code: "/usr/local/share/qemu/edk2-x86_64-code.fd", Vars: "/usr/local/share/qemu/edk2-i386-vars.fd"},
+			{Code: "/opt/homebrew/share/qemu/edk2-x86_64-code.fd", Vars: "/opt/homebrew/share/qemu/edk2-i386-vars.fd"},
+			{Code: "/usr/share/ovmf/bios.bin"},
+		}
+	}
+}
+
+// discoverFirmware resolves the OVMF/AAVMF firmware to use for UEFI boot. An
+// explicit fwPath always wins; otherwise the standard per-distro install
+// locations are probed in turn. fwVars, if set, overrides the VARS half of a
+// split CODE/VARS pair.
+func discoverFirmware(arch, fwPath, fwVars string) (firmware, error) {
+	if fwPath != "" {
+		fw := firmware{Code: fwPath, Vars: fwVars}
+		if _, err := os.Stat(fw.Code); err != nil {
+			return fw, fmt.Errorf("File [%s] does not exist, please ensure OVMF is installed", fw.Code)
+		}
+		return fw, nil
+	}
+
+	for _, fw := range firmwareCandidates(arch) {
+		if _, err := os.Stat(fw.Code); err != nil {
+			continue
+		}
+		if fw.Vars != "" {
+			if _, err := os.Stat(fw.Vars); err != nil {
+				fw.Vars = ""
+			}
+		}
+		if fwVars != "" {
+			fw.Vars = fwVars
+		}
+		return fw, nil
+	}
+
+	return firmware{}, fmt.Errorf("Unable to find OVMF/AAVMF firmware, please install it or use -fw to specify an explicit path")
+}
+
+// copyFirmwareVars copies the discovered VARS file to dst, so qemu's writes
+// to NVRAM don't mutate the shared system default.
+func copyFirmwareVars(varsPath, dst string) error {
+	data, err := ioutil.ReadFile(varsPath)
+	if err != nil {
+		return fmt.Errorf("Error reading OVMF vars file [%s]: %s", varsPath, err.Error())
+	}
+	if err := ioutil.WriteFile(dst, data, 0644); err != nil {
+		return fmt.Errorf("Error writing OVMF vars copy [%s]: %s", dst, err.Error())
+	}
+	return nil
+}
+
+// buildCidataISO writes the user-data/meta-data configured by -data or
+// -data-file to a "cidata" labelled ISO at isoPath that cloud-init/ignition
+// can consume.
+func buildCidataISO(config QemuConfig, isoPath string) error {
+	userData := config.Data
+	if config.DataFile != "" {
+		b, err := ioutil.ReadFile(config.DataFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read data file [%s]: %s", config.DataFile, err.Error())
+		}
+		userData = string(b)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "linuxkit-cidata")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "user-data"), []byte(userData), 0644); err != nil {
+		return err
+	}
+	metaData := buildCidataMetaData(config.UUID)
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "meta-data"), []byte(metaData), 0644); err != nil {
+		return err
+	}
+
+	isoTool, err := findISOTool()
+	if err != nil {
+		return err
+	}
+
+	var isoCmd *exec.Cmd
+	if filepath.Base(isoTool) == "hdiutil" {
+		isoCmd = exec.Command(isoTool, "makehybrid", "-o", isoPath, "-iso", "-joliet", "-default-volume-name", "cidata", tmpDir)
+	} else {
+		isoCmd = exec.Command(isoTool, "-output", isoPath, "-volid", "cidata", "-joliet", "-rock", tmpDir)
+	}
+	log.Debugf("%v\n", isoCmd.Args)
+	if err := isoCmd.Run(); err != nil {
+		return fmt.Errorf("Error creating cidata seed ISO: %s", err.Error())
+	}
+
+	return nil
+}
+
+// buildCidataMetaData renders the cidata "meta-data" file content for a VM
+// identified by uuid.
+func buildCidataMetaData(uuid string) string {
+	return fmt.Sprintf("instance-id: %s\nlocal-hostname: linuxkit\n", uuid)
+}
+
+// findISOTool locates whichever ISO-creation tool is available on this host.
+func findISOTool() (string, error) {
+	for _, tool := range []string{"genisoimage", "mkisofs", "xorriso", "hdiutil"} {
+		if path, err := exec.LookPath(tool); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("Unable to find genisoimage, mkisofs, xorriso or hdiutil within the $PATH, required to build a cidata seed ISO")
+}
+
+// buildSerialArg turns a -serial sink ("pty", "tcp:host:port" or a plain
+// file path) into the argument qemu's own -serial flag expects.
+func buildSerialArg(sink string) string {
+	switch {
+	case sink == "pty":
+		return "pty"
+	case strings.HasPrefix(sink, "tcp:"):
+		return fmt.Sprintf("%s,server,nowait", sink)
+	default:
+		return "file:" + sink
+	}
+}
+
+// defaultMachine returns the default QEMU machine type for an architecture.
+func defaultMachine(arch string) string {
+	switch arch {
+	case "x86_64":
+		return "q35"
+	default:
+		return "virt"
+	}
+}
+
+// selectAccel walks the colon-separated accel preference list and returns
+// the first accelerator that is available on this host, falling back to tcg.
+// containerized must be set when qemu will run inside the Linux qemu
+// container rather than directly on the host, since that rules out
+// accelerators the container has no access to (e.g. hvf on macOS).
+func selectAccel(prefs string, containerized bool) string {
+	for _, accel := range strings.Split(prefs, ":") {
+		if accelAvailable(accel, containerized) {
+			return accel
+		}
+	}
+	return "tcg"
+}
+
+// accelAvailable checks whether a given accelerator can actually be used.
+func accelAvailable(accel string, containerized bool) bool {
+	switch accel {
+	case "kvm":
+		if runtime.GOOS != "linux" {
+			return false
+		}
+		_, err := os.Stat("/dev/kvm")
+		return err == nil
+	case "hvf":
+		// hvf is macOS's Hypervisor.framework: it's not reachable from
+		// inside the Linux qemu container, only from a qemu binary running
+		// directly on the host.
+		if containerized || runtime.GOOS != "darwin" {
+			return false
+		}
+		out, err := exec.Command("sysctl", "-n", "kern.hv_support").Output()
+		if err != nil {
+			return false
+		}
+		return strings.TrimSpace(string(out)) == "1"
+	case "tcg":
+		return true
+	default:
+		return false
+	}
+}
+
 func discoverBackend(config QemuConfig) QemuConfig {
 	qemuBinPath := "qemu-system-" + config.Arch
 	qemuImgPath := "qemu-img"
@@ -329,6 +680,106 @@ func buildPath(prefix string, postfix string) string {
 	return path
 }
 
+// Disk holds the configuration for a single qemu drive.
+type Disk struct {
+	Path      string
+	Size      string
+	Format    string
+	Interface string
+}
+
+// Disks is a repeatable -disk flag, one entry per attached disk.
+type Disks []Disk
+
+func (d *Disks) String() string {
+	return "A disk flag is a type of flag that can be repeated any number of times"
+}
+
+func (d *Disks) Set(value string) error {
+	disk, err := parseDiskSpec(value)
+	if err != nil {
+		return err
+	}
+	*d = append(*d, disk)
+	return nil
+}
+
+// parseDiskSpec parses a disk spec of the form
+// [file=]path[,size=1G][,format=qcow2][,if=virtio|ide|scsi]
+func parseDiskSpec(spec string) (Disk, error) {
+	disk := Disk{
+		Format:    "qcow2",
+		Interface: "virtio",
+	}
+	for i, field := range strings.Split(spec, ",") {
+		key, value := field, ""
+		if idx := strings.Index(field, "="); idx != -1 {
+			key, value = field[:idx], field[idx+1:]
+		} else if i == 0 {
+			// allow a bare path as the first field
+			key, value = "file", field
+		}
+		switch key {
+		case "file":
+			disk.Path = value
+		case "size":
+			disk.Size = value
+		case "format":
+			disk.Format = value
+		case "if":
+			if value != "virtio" && value != "ide" && value != "scsi" {
+				return disk, fmt.Errorf("Invalid disk interface [%s], valid options are: virtio, ide and scsi", value)
+			}
+			disk.Interface = value
+		default:
+			return disk, fmt.Errorf("Unknown disk option [%s] in spec [%s]", key, spec)
+		}
+	}
+	if disk.Path == "" {
+		return disk, fmt.Errorf("Disk spec [%s] is missing a path", spec)
+	}
+	return disk, nil
+}
+
+// parseNetworkingSpec parses a -networking spec of the form
+// none|user|tap[,ifname=name]|bridge,br=name
+func parseNetworkingSpec(spec string) (Networking, error) {
+	fields := strings.Split(spec, ",")
+	mode := fields[0]
+
+	net := Networking{Mode: mode}
+	switch mode {
+	case "none", "user":
+	case "tap":
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "ifname=") {
+				net.IfName = strings.TrimPrefix(field, "ifname=")
+			}
+		}
+	case "bridge":
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "br=") {
+				net.Bridge = strings.TrimPrefix(field, "br=")
+			}
+		}
+		if net.Bridge == "" {
+			return net, fmt.Errorf("Networking mode 'bridge' requires a 'br=' name")
+		}
+	default:
+		return net, fmt.Errorf("Unknown networking mode [%s], valid options are: none, user, tap and bridge", mode)
+	}
+	return net, nil
+}
+
+// generateMAC derives a locally-administered unicast MAC address from a
+// freshly generated UUID, so each call returns a new random address.
+func generateMAC() string {
+	id := uuid.NewV4()
+	mac := id[0:6]
+	mac[0] = (mac[0] | 0x02) & 0xfe
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
+}
+
 type multipleFlag []string
 
 type publishedPorts struct {
@@ -391,7 +842,7 @@ func splitPublish(publish string) (publishedPorts, error) {
 }
 
 func buildQemuForwardings(publishFlags multipleFlag, containerized bool) (string, error) {
-	forwardings := "user"
+	var forwardings []string
 	for _, publish := range publishFlags {
 		p, err := splitPublish(publish)
 		if err != nil {
@@ -404,10 +855,10 @@ func buildQemuForwardings(publishFlags multipleFlag, containerized bool) (string
 		if containerized {
 			hostPort = guestPort
 		}
-		forwardings = fmt.Sprintf("%s,hostfwd=%s::%d-:%d", forwardings, p.protocol, hostPort, guestPort)
+		forwardings = append(forwardings, fmt.Sprintf("hostfwd=%s::%d-:%d", p.protocol, hostPort, guestPort))
 	}
 
-	return forwardings, nil
+	return strings.Join(forwardings, ","), nil
 }
 
 func buildDockerForwardings(publishedPorts []string) ([]string, error) {
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDefaultMachine(t *testing.T) {
+	cases := []struct {
+		arch string
+		want string
+	}{
+		{"x86_64", "q35"},
+		{"aarch64", "virt"},
+		{"arm", "virt"},
+		{"", "virt"},
+	}
+	for _, c := range cases {
+		if got := defaultMachine(c.arch); got != c.want {
+			t.Errorf("defaultMachine(%q) = %q, want %q", c.arch, got, c.want)
+		}
+	}
+}
+
+func TestAccelAvailableTCGAlwaysAvailable(t *testing.T) {
+	if !accelAvailable("tcg", false) {
+		t.Error("accelAvailable(\"tcg\", false) = false, want true")
+	}
+	if !accelAvailable("tcg", true) {
+		t.Error("accelAvailable(\"tcg\", true) = false, want true")
+	}
+}
+
+func TestAccelAvailableUnknown(t *testing.T) {
+	if accelAvailable("bogus", false) {
+		t.Error("accelAvailable(\"bogus\", false) = true, want false")
+	}
+}
+
+func TestAccelAvailableHVFNeverAvailableContainerized(t *testing.T) {
+	if accelAvailable("hvf", true) {
+		t.Error("accelAvailable(\"hvf\", true) = true, want false: hvf isn't reachable from inside the qemu container")
+	}
+}
+
+func TestSelectAccelFallsBackToTCG(t *testing.T) {
+	if got := selectAccel("bogus1:bogus2", false); got != "tcg" {
+		t.Errorf("selectAccel(%q, false) = %q, want %q", "bogus1:bogus2", got, "tcg")
+	}
+}
+
+func TestSelectAccelSkipsHVFWhenContainerized(t *testing.T) {
+	if got := selectAccel("hvf", true); got != "tcg" {
+		t.Errorf("selectAccel(%q, true) = %q, want %q", "hvf", got, "tcg")
+	}
+}
+
+func TestParseDiskSpec(t *testing.T) {
+	cases := []struct {
+		spec string
+		want Disk
+	}{
+		{"disk.img", Disk{Path: "disk.img", Format: "qcow2", Interface: "virtio"}},
+		{"file=disk.img", Disk{Path: "disk.img", Format: "qcow2", Interface: "virtio"}},
+		{"disk.img,size=1G", Disk{Path: "disk.img", Size: "1G", Format: "qcow2", Interface: "virtio"}},
+		{"disk.img,format=raw", Disk{Path: "disk.img", Format: "raw", Interface: "virtio"}},
+		{"disk.img,if=ide", Disk{Path: "disk.img", Format: "qcow2", Interface: "ide"}},
+	}
+	for _, c := range cases {
+		got, err := parseDiskSpec(c.spec)
+		if err != nil {
+			t.Errorf("parseDiskSpec(%q) returned error: %v", c.spec, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseDiskSpec(%q) = %+v, want %+v", c.spec, got, c.want)
+		}
+	}
+}
+
+func TestDiscoverFirmwareExplicitPath(t *testing.T) {
+	code, err := ioutil.TempFile("", "ovmf-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(code.Name())
+
+	fw, err := discoverFirmware("x86_64", code.Name(), "/some/vars")
+	if err != nil {
+		t.Fatalf("discoverFirmware returned error: %v", err)
+	}
+	if fw.Code != code.Name() || fw.Vars != "/some/vars" {
+		t.Errorf("discoverFirmware(explicit) = %+v, want {Code: %q, Vars: /some/vars}", fw, code.Name())
+	}
+}
+
+func TestDiscoverFirmwareExplicitPathMissing(t *testing.T) {
+	if _, err := discoverFirmware("x86_64", "/does/not/exist", ""); err == nil {
+		t.Error("discoverFirmware with a missing -fw path returned no error, want one")
+	}
+}
+
+func TestBuildSerialArg(t *testing.T) {
+	cases := []struct {
+		sink string
+		want string
+	}{
+		{"pty", "pty"},
+		{"tcp:localhost:1234", "tcp:localhost:1234,server,nowait"},
+		{"vm.log", "file:vm.log"},
+	}
+	for _, c := range cases {
+		if got := buildSerialArg(c.sink); got != c.want {
+			t.Errorf("buildSerialArg(%q) = %q, want %q", c.sink, got, c.want)
+		}
+	}
+}
+
+func TestParseNetworkingSpec(t *testing.T) {
+	cases := []struct {
+		spec string
+		want Networking
+	}{
+		{"none", Networking{Mode: "none"}},
+		{"user", Networking{Mode: "user"}},
+		{"tap", Networking{Mode: "tap"}},
+		{"tap,ifname=tap1", Networking{Mode: "tap", IfName: "tap1"}},
+		{"bridge,br=br0", Networking{Mode: "bridge", Bridge: "br0"}},
+	}
+	for _, c := range cases {
+		got, err := parseNetworkingSpec(c.spec)
+		if err != nil {
+			t.Errorf("parseNetworkingSpec(%q) returned error: %v", c.spec, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseNetworkingSpec(%q) = %+v, want %+v", c.spec, got, c.want)
+		}
+	}
+}
+
+func TestParseNetworkingSpecErrors(t *testing.T) {
+	cases := []string{
+		"bridge",
+		"bogus",
+	}
+	for _, spec := range cases {
+		if _, err := parseNetworkingSpec(spec); err == nil {
+			t.Errorf("parseNetworkingSpec(%q) returned no error, want one", spec)
+		}
+	}
+}
+
+func TestBuildCidataMetaData(t *testing.T) {
+	got := buildCidataMetaData("1234-uuid")
+	want := "instance-id: 1234-uuid\nlocal-hostname: linuxkit\n"
+	if got != want {
+		t.Errorf("buildCidataMetaData(%q) = %q, want %q", "1234-uuid", got, want)
+	}
+}
+
+func TestFindISOToolNoneFound(t *testing.T) {
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+
+	emptyDir, err := ioutil.TempDir("", "linuxkit-empty-path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(emptyDir)
+	os.Setenv("PATH", emptyDir)
+
+	if _, err := findISOTool(); err == nil {
+		t.Error("findISOTool() with no tool on PATH returned no error, want one")
+	}
+}
+
+func TestParseDiskSpecErrors(t *testing.T) {
+	cases := []string{
+		"",
+		"size=1G",
+		"disk.img,if=nvme",
+		"disk.img,bogus=1",
+	}
+	for _, spec := range cases {
+		if _, err := parseDiskSpec(spec); err == nil {
+			t.Errorf("parseDiskSpec(%q) returned no error, want one", spec)
+		}
+	}
+}